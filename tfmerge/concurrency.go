@@ -0,0 +1,335 @@
+package tfmerge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// pulledState is the outcome of pulling and rewriting one source state file
+// in its own worker: the resource addresses it contributes (before and
+// after rewrite rules are applied), the serial/lineage Terraform observed
+// on it, and the path to a v4 state file holding just those resources,
+// ready to be folded into the final merged state.
+type pulledState struct {
+	source    string
+	origAddrs []string
+	addrs     []string
+	serial    int
+	lineage   string
+	statePath string
+
+	// workerDir is the scratch working directory pullState created for this
+	// source. It stays alive after pullState returns, since statePath points
+	// inside it and combinePulledStates still needs to read that file; the
+	// caller is responsible for removing it once combinePulledStates (or an
+	// error path that will never call it) is done with it.
+	workerDir string
+}
+
+// pullStatesConcurrently runs the per-file "prepare, pull and move" phase of
+// Merge across a pool of concurrency workers. Each worker gets its own
+// working directory and *tfexec.Terraform* instance (copied from tf's
+// already-initialized one, so it reuses the same provider plugin cache
+// instead of re-running `terraform init`), so workers never contend for the
+// same state file or working directory. Only the final conflict-check and
+// write is left to run serially, in Merge itself.
+func pullStatesConcurrently(ctx context.Context, tf *tfexec.Terraform, stateFiles []string, rules []RewriteRule, concurrency int) ([]pulledState, error) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	results := make([]pulledState, len(stateFiles))
+	errs := make([]error, len(stateFiles))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, stateFile := range stateFiles {
+		i, stateFile := i, stateFile
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = pullState(ctx, tf, stateFile, i, rules)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			// Nothing downstream will read these workers' statePaths now, so
+			// clean them all up here rather than leaking them back to the
+			// caller along with the error.
+			for _, r := range results {
+				if r.workerDir != "" {
+					os.RemoveAll(r.workerDir)
+				}
+			}
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// pullState prepares (upgrading if legacy), lists and moves the resources
+// of one source state file into a scratch state file local to a dedicated
+// worker working directory, so it can run concurrently with other calls to
+// pullState without touching shared state. The returned pulledState's
+// workerDir is set whenever the worker dir was created (even if a later step
+// fails), so the caller can remove it once it's done reading statePath.
+func pullState(ctx context.Context, tf *tfexec.Terraform, stateFile string, index int, rules []RewriteRule) (pulledState, error) {
+	workerDir, err := os.MkdirTemp("", fmt.Sprintf("tfmerge-worker-%d-", index))
+	if err != nil {
+		return pulledState{}, fmt.Errorf("creating worker dir for %s: %v", stateFile, err)
+	}
+	result, err := pullStateInto(ctx, tf, workerDir, stateFile, index, rules)
+	result.workerDir = workerDir
+	return result, err
+}
+
+// pullStateInto does the actual pull/move work for pullState inside the
+// already-created workerDir.
+func pullStateInto(ctx context.Context, tf *tfexec.Terraform, workerDir, stateFile string, index int, rules []RewriteRule) (pulledState, error) {
+	origin := stateFile
+
+	if err := copyDir(tf.WorkingDir(), workerDir); err != nil {
+		return pulledState{}, fmt.Errorf("staging worker dir for %s: %v", origin, err)
+	}
+	workerTF, err := tfexec.NewTerraform(workerDir, tf.ExecPath())
+	if err != nil {
+		return pulledState{}, fmt.Errorf("creating worker terraform for %s: %v", origin, err)
+	}
+
+	// stateFile may be a local path or a remote-state backend URI (s3://,
+	// azurerm://, gs://, consul://, http(s)://, tfe://); resolve it to a
+	// local scratch file so the rest of the pull pipeline can stay
+	// path-based.
+	if source, ok, err := resolveStateSource(workerTF, stateFile); err != nil {
+		return pulledState{}, fmt.Errorf("resolving %s: %v", origin, err)
+	} else if ok {
+		defer source.Close()
+		data, err := source.Pull(ctx)
+		if err != nil {
+			return pulledState{}, fmt.Errorf("pulling %s: %v", origin, err)
+		}
+		sourcePath := filepath.Join(workerDir, "source.tfstate")
+		if err := os.WriteFile(sourcePath, data, 0600); err != nil {
+			return pulledState{}, fmt.Errorf("staging %s: %v", origin, err)
+		}
+		stateFile = sourcePath
+	}
+
+	preparedPath, err := prepareStateFile(workerTF, stateFile, index)
+	if err != nil {
+		return pulledState{}, fmt.Errorf("preparing %s: %v", origin, err)
+	}
+
+	// `terraform state mv` rewrites its -state file without the moved
+	// resources, so move out of a scratch copy rather than the caller's file.
+	movePath := filepath.Join(workerDir, "moving.tfstate")
+	if err := copyFile(preparedPath, movePath); err != nil {
+		return pulledState{}, fmt.Errorf("staging %s: %v", origin, err)
+	}
+
+	serial, lineage, err := serialAndLineage(movePath)
+	if err != nil {
+		return pulledState{}, fmt.Errorf("reading %s: %v", origin, err)
+	}
+
+	addrs, err := stateAddresses(ctx, workerTF, movePath)
+	if err != nil {
+		return pulledState{}, fmt.Errorf("listing resources of %s: %v", origin, err)
+	}
+
+	localPath := filepath.Join(workerDir, "pulled.tfstate")
+	rewritten := make([]string, len(addrs))
+	for i, addr := range addrs {
+		toAddr := applyRewriteRules(addr, rules)
+		rewritten[i] = toAddr
+		if err := workerTF.StateMv(ctx, addr, toAddr, tfexec.State(movePath), tfexec.StateOut(localPath)); err != nil {
+			return pulledState{}, fmt.Errorf("moving %s to %s from %s: %v", addr, toAddr, origin, err)
+		}
+	}
+
+	return pulledState{
+		source:    origin,
+		origAddrs: addrs,
+		addrs:     rewritten,
+		serial:    serial,
+		lineage:   lineage,
+		statePath: localPath,
+	}, nil
+}
+
+// serialAndLineage reads the "serial" and "lineage" fields out of the state
+// file at path. If path does not exist, both are zero values.
+func serialAndLineage(path string) (int, string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	var s struct {
+		Serial  int    `json:"serial"`
+		Lineage string `json:"lineage"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, "", err
+	}
+	return s.Serial, s.Lineage, nil
+}
+
+// combinePulledStates folds the resources pulled by pullStatesConcurrently
+// into baseState (which may be empty) and returns the resulting state in
+// its JSON-encoded wire format. Every pulled state is already valid v4
+// JSON produced by Terraform itself, so this is a plain JSON-level append
+// rather than another round of `terraform state mv` calls.
+func combinePulledStates(baseState []byte, pulled []pulledState) ([]byte, error) {
+	hasBase := len(baseState) != 0
+	startIdx := 0
+
+	// seedIdx is the first pulled state with resources of its own, i.e. the
+	// first one that actually wrote its statePath (pullState only writes it
+	// when there's at least one address to move): that's the only one we
+	// can seed version/lineage/terraform_version from. Sources ahead of it
+	// contributed nothing and are simply skipped.
+	seedIdx := -1
+	for i, p := range pulled {
+		if len(p.addrs) != 0 {
+			seedIdx = i
+			break
+		}
+	}
+
+	var combined map[string]interface{}
+	switch {
+	case hasBase:
+		if err := json.Unmarshal(baseState, &combined); err != nil {
+			return nil, fmt.Errorf("parsing base state: %v", err)
+		}
+	case seedIdx >= 0:
+		// No base state was given, so seed version/lineage/terraform_version
+		// (and the seed file's own resources) from the first pulled state
+		// with resources of its own: it already carries a lineage Terraform
+		// assigned when it was pulled, which this merged state can just
+		// inherit rather than minting a new one itself.
+		seed, err := os.ReadFile(pulled[seedIdx].statePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading pulled state for %s: %v", pulled[seedIdx].source, err)
+		}
+		if err := json.Unmarshal(seed, &combined); err != nil {
+			return nil, fmt.Errorf("parsing pulled state for %s: %v", pulled[seedIdx].source, err)
+		}
+		startIdx = seedIdx + 1
+	default:
+		combined = map[string]interface{}{"version": 4, "resources": []interface{}{}, "outputs": map[string]interface{}{}}
+	}
+
+	resources, _ := combined["resources"].([]interface{})
+	// Every pulled source bumps the serial by one, whether or not it ended
+	// up seeding combined or contributing any resources.
+	serial := len(pulled)
+	if hasBase {
+		serial++
+	}
+
+	for _, p := range pulled[startIdx:] {
+		if len(p.addrs) == 0 {
+			continue // this source contributed no resources, so it never wrote a pulled state file
+		}
+		data, err := os.ReadFile(p.statePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading pulled state for %s: %v", p.source, err)
+		}
+		var partial map[string]interface{}
+		if err := json.Unmarshal(data, &partial); err != nil {
+			return nil, fmt.Errorf("parsing pulled state for %s: %v", p.source, err)
+		}
+		partialResources, _ := partial["resources"].([]interface{})
+		resources = append(resources, partialResources...)
+	}
+
+	combined["version"] = 4
+	combined["serial"] = serial
+	combined["resources"] = resources
+	if combined["outputs"] == nil {
+		combined["outputs"] = map[string]interface{}{}
+	}
+
+	return json.MarshalIndent(combined, "", "  ")
+}
+
+// copyDir recreates src's working directory layout at dst, which must
+// already exist: small per-root files (configuration, the dependency lock
+// file) are copied with their original permissions preserved, but the
+// ".terraform" directory - where `terraform init` installs provider
+// plugins - is symlinked rather than copied, so every merge worker shares
+// one plugin cache instead of each paying the cost (disk and, for large
+// providers, meaningful time) of duplicating every provider binary.
+func copyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		if entry.Name() == ".terraform" {
+			absSrcPath, err := filepath.Abs(srcPath)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(absSrcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			if err := os.MkdirAll(dstPath, 0755); err != nil {
+				return err
+			}
+			if err := copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst, preserving src's file mode so that, e.g., an
+// executable copied this way is still executable.
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,222 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// legacyState is the minimal shape of a Terraform state file at schema
+// version 1-3, sufficient to translate its resources into the v4 format the
+// rest of this package understands. Versions prior to v4 nested resource
+// instances under a numbered "modules" list, each holding a flatmap of
+// "Attributes" rather than the "attributes_flat"/"attributes" pair used
+// from v4 onwards.
+type legacyState struct {
+	Version int                 `json:"version"`
+	Serial  int                 `json:"serial"`
+	Lineage string              `json:"lineage"`
+	Modules []legacyStateModule `json:"modules"`
+}
+
+type legacyStateModule struct {
+	Path      []string                       `json:"path"`
+	Resources map[string]legacyResourceState `json:"resources"`
+}
+
+type legacyResourceState struct {
+	Type     string              `json:"type"`
+	Primary  legacyInstanceState `json:"primary"`
+	Provider string              `json:"provider"`
+}
+
+type legacyInstanceState struct {
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// detectStateVersion returns the "version" field of a Terraform state file
+// without otherwise parsing it.
+func detectStateVersion(data []byte) (int, error) {
+	var v struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, fmt.Errorf("parsing state version: %v", err)
+	}
+	return v.Version, nil
+}
+
+// upgradeLegacyState converts a v1-v3 state into the v4 JSON representation
+// that `terraform state mv` (and the rest of this package) expects. It
+// mimics the semantics of Terraform's own internal/legacy upgrader: each
+// legacy resource's flatmap Attributes are expanded into the structured
+// "attributes" a v4 instance carries, and its short provider reference
+// (e.g. "provider.null") is qualified into the registry address v4 uses,
+// since downstream consumers (including `terraform state mv` itself)
+// compare provider addresses, not legacy shorthands.
+func upgradeLegacyState(data []byte) ([]byte, error) {
+	var legacy legacyState
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("parsing legacy state: %v", err)
+	}
+
+	type v4Instance struct {
+		SchemaVersion       int                    `json:"schema_version"`
+		Attributes          map[string]interface{} `json:"attributes"`
+		SensitiveAttributes []interface{}          `json:"sensitive_attributes"`
+		Private             string                 `json:"private"`
+	}
+	type v4Resource struct {
+		Mode      string       `json:"mode"`
+		Type      string       `json:"type"`
+		Name      string       `json:"name"`
+		Provider  string       `json:"provider"`
+		Module    string       `json:"module,omitempty"`
+		Instances []v4Instance `json:"instances"`
+	}
+	type v4State struct {
+		Version          int                    `json:"version"`
+		TerraformVersion string                 `json:"terraform_version"`
+		Serial           int                    `json:"serial"`
+		Lineage          string                 `json:"lineage"`
+		Outputs          map[string]interface{} `json:"outputs"`
+		Resources        []v4Resource           `json:"resources"`
+	}
+
+	out := v4State{
+		Version: 4,
+		Serial:  legacy.Serial,
+		Lineage: legacy.Lineage,
+		Outputs: map[string]interface{}{},
+	}
+
+	for _, mod := range legacy.Modules {
+		// mod.Path[0] is always "root"; anything after that is the module
+		// address, e.g. ["root", "a", "b"] -> "module.a.module.b".
+		var modAddr string
+		if len(mod.Path) > 1 {
+			parts := make([]string, 0, len(mod.Path)-1)
+			for _, p := range mod.Path[1:] {
+				parts = append(parts, fmt.Sprintf("module.%s", p))
+			}
+			modAddr = strings.Join(parts, ".")
+		}
+
+		for key, res := range mod.Resources {
+			mode := "managed"
+			name := key
+			if strings.HasPrefix(key, "data.") {
+				mode = "data"
+				key = strings.TrimPrefix(key, "data.")
+			}
+			if idx := strings.Index(key, "."); idx >= 0 {
+				name = key[idx+1:]
+			}
+			out.Resources = append(out.Resources, v4Resource{
+				Mode:     mode,
+				Type:     res.Type,
+				Name:     name,
+				Provider: qualifyLegacyProvider(res.Provider),
+				Module:   modAddr,
+				Instances: []v4Instance{
+					{
+						SchemaVersion:       0,
+						Attributes:          expandFlatmapAttributes(res.Primary.Attributes),
+						SensitiveAttributes: []interface{}{},
+						// Legacy state never carried a provider-private blob;
+						// "bnVsbA==" is the base64 encoding of the JSON
+						// literal null, matching what the v4 upgrader emits
+						// for resources with none.
+						Private: "bnVsbA==",
+					},
+				},
+			})
+		}
+	}
+
+	return json.MarshalIndent(out, "", "  ")
+}
+
+// qualifyLegacyProvider expands a legacy resource's short provider
+// reference (e.g. "provider.null", or "provider.aws.west" for an aliased
+// provider) into the fully-qualified v4 provider address, assuming the
+// registry.terraform.io/hashicorp namespace that legacy configurations
+// implicitly used before provider source addresses existed.
+func qualifyLegacyProvider(provider string) string {
+	name := strings.TrimPrefix(provider, "provider.")
+	alias := ""
+	if idx := strings.Index(name, "."); idx >= 0 {
+		name, alias = name[:idx], name[idx:]
+	}
+	return fmt.Sprintf("provider[%q]", "registry.terraform.io/hashicorp/"+name) + alias
+}
+
+// expandFlatmapAttributes turns a v1-v3 instance's flatmap Attributes into
+// the nested JSON object a v4 instance's "attributes" expects. It handles
+// the flatmap shapes Terraform's legacy state actually produces: scalars,
+// and "%"/"#"-counted maps and lists of scalars. A zero-count collection
+// decodes to a JSON null, matching Terraform's own v3->v4 state upgrader,
+// which can't tell an empty optional attribute from an absent one without
+// the provider's schema.
+func expandFlatmapAttributes(flat map[string]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	children := map[string]map[string]string{}
+	counts := map[string]string{} // top-level key -> "%"/"#" count
+	sigils := map[string]byte{}   // top-level key -> '%' (map) or '#' (list/set)
+
+	for k, v := range flat {
+		top, rest, nested := strings.Cut(k, ".")
+		if !nested {
+			result[top] = v
+			continue
+		}
+		if rest == "%" || rest == "#" {
+			counts[top] = v
+			sigils[top] = rest[0]
+			continue
+		}
+		if children[top] == nil {
+			children[top] = map[string]string{}
+		}
+		children[top][rest] = v
+	}
+
+	for top, count := range counts {
+		if count == "0" {
+			result[top] = nil
+			continue
+		}
+		items := children[top]
+		if sigils[top] == '#' {
+			indices := make([]string, 0, len(items))
+			for idx := range items {
+				indices = append(indices, idx)
+			}
+			// Sort numerically, so that e.g. index "10" comes after "2".
+			sort.Slice(indices, func(i, j int) bool {
+				a, errA := strconv.Atoi(indices[i])
+				b, errB := strconv.Atoi(indices[j])
+				if errA != nil || errB != nil {
+					return indices[i] < indices[j]
+				}
+				return a < b
+			})
+			list := make([]interface{}, 0, len(indices))
+			for _, idx := range indices {
+				list = append(list, items[idx])
+			}
+			result[top] = list
+			continue
+		}
+		m := map[string]interface{}{}
+		for k, v := range items {
+			m[k] = v
+		}
+		result[top] = m
+	}
+
+	return result
+}
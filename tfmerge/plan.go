@@ -0,0 +1,152 @@
+package tfmerge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// MergePlans merges the Terraform binary plan files in planFiles into
+// basePlan (which may be empty) and returns the resulting plan in the same
+// JSON form produced by `terraform show -json`. tf is used to decode each
+// plan file via its embedded prior state and planned resource changes.
+//
+// This is the plan-file analogue of Merge: CI pipelines that shard
+// `terraform plan` across many roots can use it to produce one aggregate
+// plan for review, the same way Merge aggregates sharded state.
+//
+// MergePlans fails if any two input plans (including basePlan) contain a
+// resource change for the same address, since there is no way to tell which
+// change should win.
+func MergePlans(ctx context.Context, tf *tfexec.Terraform, basePlan string, planFiles ...string) ([]byte, error) {
+	var plans []*tfjson.Plan
+	var sources []string
+
+	if basePlan != "" {
+		plan, err := tf.ShowPlanFile(ctx, basePlan)
+		if err != nil {
+			return nil, fmt.Errorf("reading base plan %s: %v", basePlan, err)
+		}
+		plans = append(plans, plan)
+		sources = append(sources, "<base plan>")
+	}
+
+	for _, planFile := range planFiles {
+		plan, err := tf.ShowPlanFile(ctx, planFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading plan %s: %v", planFile, err)
+		}
+		plans = append(plans, plan)
+		sources = append(sources, planFile)
+	}
+
+	merged, err := mergePlanValues(sources, plans...)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(merged)
+}
+
+// mergePlanValues merges plans into a single *tfjson.Plan, detecting
+// overlapping resource addresses the same way Merge detects state
+// conflicts. sources holds a human-readable origin for each entry in plans,
+// used to produce useful conflict errors.
+func mergePlanValues(sources []string, plans ...*tfjson.Plan) (*tfjson.Plan, error) {
+	merged := &tfjson.Plan{FormatVersion: "1.2"}
+	seen := map[string]string{}
+
+	for i, plan := range plans {
+		for _, rc := range plan.ResourceChanges {
+			if src, ok := seen[rc.Address]; ok {
+				return nil, fmt.Errorf("resource %s exists in both %s and %s", rc.Address, src, sources[i])
+			}
+			seen[rc.Address] = sources[i]
+		}
+
+		merged.ResourceChanges = append(merged.ResourceChanges, plan.ResourceChanges...)
+		merged.OutputChanges = mergeOutputChanges(merged.OutputChanges, plan.OutputChanges)
+		merged.PriorState = mergePriorState(merged.PriorState, plan.PriorState)
+		merged.PlannedValues = mergePlannedValues(merged.PlannedValues, plan.PlannedValues)
+		if merged.Config == nil {
+			// Config is the root module's static configuration, which is
+			// assumed identical across shards of the same root (that's what
+			// makes them shards of one plan rather than unrelated plans);
+			// take the first one seen rather than merging.
+			merged.Config = plan.Config
+		}
+	}
+
+	return merged, nil
+}
+
+// mergePlannedValues merges plan.PlannedValues's root and child module
+// resources into into, the same way mergePlanValues merges ResourceChanges:
+// conflicts are already ruled out by the address check in mergePlanValues,
+// so this only needs to concatenate.
+func mergePlannedValues(into, from *tfjson.StateValues) *tfjson.StateValues {
+	if from == nil || from.RootModule == nil {
+		return into
+	}
+	if into == nil || into.RootModule == nil {
+		return from
+	}
+	mergeStateModule(into.RootModule, from.RootModule)
+	return into
+}
+
+// mergeStateModule appends from's resources and child modules onto into,
+// recursing into child modules that exist on both sides so that same-named
+// nested modules from different plan shards don't shadow one another.
+func mergeStateModule(into, from *tfjson.StateModule) {
+	into.Resources = append(into.Resources, from.Resources...)
+
+	for _, fromChild := range from.ChildModules {
+		var intoChild *tfjson.StateModule
+		for _, existing := range into.ChildModules {
+			if existing.Address == fromChild.Address {
+				intoChild = existing
+				break
+			}
+		}
+		if intoChild == nil {
+			into.ChildModules = append(into.ChildModules, fromChild)
+			continue
+		}
+		mergeStateModule(intoChild, fromChild)
+	}
+}
+
+func mergeOutputChanges(into, from map[string]*tfjson.Change) map[string]*tfjson.Change {
+	if from == nil {
+		return into
+	}
+	if into == nil {
+		into = map[string]*tfjson.Change{}
+	}
+	for k, v := range from {
+		into[k] = v
+	}
+	return into
+}
+
+func mergePriorState(into, from *tfjson.State) *tfjson.State {
+	if from == nil {
+		return into
+	}
+	if into == nil {
+		return from
+	}
+	if from.Values == nil || from.Values.RootModule == nil {
+		return into
+	}
+	if into.Values == nil || into.Values.RootModule == nil {
+		into.Values = from.Values
+		return into
+	}
+	into.Values.RootModule.Resources = append(into.Values.RootModule.Resources, from.Values.RootModule.Resources...)
+	return into
+}
@@ -0,0 +1,148 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// MergeReport records what a call to Merge actually did: per input state,
+// the resource addresses it contributed and any it rewrote, the
+// serial/lineage Terraform observed on it, and any near-conflicts (the same
+// resource type and name appearing in different modules) worth a reviewer's
+// attention even though they didn't collide outright. It turns Merge from
+// an opaque byte-producer into something reviewable, e.g. as a JSON comment
+// on the CI run that produced the merge.
+type MergeReport struct {
+	Sources       []SourceReport `json:"sources"`
+	NearConflicts []NearConflict `json:"near_conflicts,omitempty"`
+}
+
+// SourceReport is the contribution of a single input state (or baseState,
+// reported as "<base state>") to a merge.
+type SourceReport struct {
+	Source    string            `json:"source"`
+	Serial    int               `json:"serial"`
+	Lineage   string            `json:"lineage"`
+	Added     []string          `json:"added"`
+	Rewritten map[string]string `json:"rewritten,omitempty"`
+}
+
+// NearConflict is a resource type and name that appears under more than one
+// module in the merged state. It isn't a conflict Merge refuses to resolve
+// (the full addresses differ), but is usually worth a second look, since it
+// often means the same logical resource was declared independently in two
+// roots.
+type NearConflict struct {
+	Type      string   `json:"type"`
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+// buildReport assembles the MergeReport for a merge of baseState and pulled.
+func buildReport(baseState []byte, baseAddrs []string, pulled []pulledState) (*MergeReport, error) {
+	report := &MergeReport{}
+	byTypeName := map[[2]string][]string{}
+
+	if len(baseState) != 0 {
+		serial, lineage, err := stateSerialAndLineageFromBytes(baseState)
+		if err != nil {
+			return nil, err
+		}
+		report.Sources = append(report.Sources, SourceReport{
+			Source:  "<base state>",
+			Serial:  serial,
+			Lineage: lineage,
+			Added:   baseAddrs,
+		})
+		for _, addr := range baseAddrs {
+			addToNearConflictIndex(byTypeName, addr)
+		}
+	}
+
+	for _, p := range pulled {
+		rewritten := map[string]string{}
+		for i, orig := range p.origAddrs {
+			if to := p.addrs[i]; to != orig {
+				rewritten[orig] = to
+			}
+		}
+		report.Sources = append(report.Sources, SourceReport{
+			Source:    p.source,
+			Serial:    p.serial,
+			Lineage:   p.lineage,
+			Added:     p.addrs,
+			Rewritten: rewritten,
+		})
+		for _, addr := range p.addrs {
+			addToNearConflictIndex(byTypeName, addr)
+		}
+	}
+
+	for key, addrs := range byTypeName {
+		if len(addrs) < 2 {
+			continue
+		}
+		report.NearConflicts = append(report.NearConflicts, NearConflict{
+			Type:      key[0],
+			Name:      key[1],
+			Addresses: addrs,
+		})
+	}
+
+	return report, nil
+}
+
+// addToNearConflictIndex records addr under its (type, name) key only when
+// it comes from a different module than an address already seen for that
+// key: addresses in the same module (e.g. different instances of one
+// resource) are not a near-conflict.
+func addToNearConflictIndex(index map[[2]string][]string, addr string) {
+	module, typ, name := splitAddress(addr)
+	if typ == "" {
+		return
+	}
+	key := [2]string{typ, name}
+	for _, existing := range index[key] {
+		if existingModule, _, _ := splitAddress(existing); existingModule == module {
+			return
+		}
+	}
+	index[key] = append(index[key], addr)
+}
+
+// splitAddress breaks a resource address into its module path (e.g.
+// "module.a", or "" for the root module), resource type and resource name,
+// ignoring any trailing instance key (e.g. `["a"]`, `[0]`).
+func splitAddress(addr string) (module, typ, name string) {
+	if idx := strings.IndexByte(addr, '['); idx >= 0 {
+		addr = addr[:idx]
+	}
+
+	parts := strings.Split(addr, ".")
+	i := 0
+	var modParts []string
+	for i+1 < len(parts) && parts[i] == "module" {
+		modParts = append(modParts, parts[i], parts[i+1])
+		i += 2
+	}
+	if i < len(parts) && parts[i] == "data" {
+		i++
+	}
+	if i+1 >= len(parts) {
+		return strings.Join(modParts, "."), "", ""
+	}
+	return strings.Join(modParts, "."), parts[i], parts[i+1]
+}
+
+// stateSerialAndLineageFromBytes extracts the "serial" and "lineage" fields
+// from a state file's raw JSON.
+func stateSerialAndLineageFromBytes(data []byte) (int, string, error) {
+	var s struct {
+		Serial  int    `json:"serial"`
+		Lineage string `json:"lineage"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, "", err
+	}
+	return s.Serial, s.Lineage, nil
+}
@@ -0,0 +1,79 @@
+package tfmerge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites a resource address matching From into To before that
+// address is merged. From is compiled from a glob-style pattern (module
+// addresses use "*" as a wildcard, e.g. "module.a.*") or a full regular
+// expression; To may reference the wildcard's capture using "${1}", "${2}",
+// etc, in the order the wildcards appeared in From.
+type RewriteRule struct {
+	From *regexp.Regexp
+	To   string
+}
+
+// ParseRewriteRule parses a "from=to" rule such as
+// "module.a.*=module.shard1.a.*" into a RewriteRule. Sharding a monolithic
+// root into per-team states can then re-key resources on the fly, rather
+// than pre-processing each state file, by passing rules like this via
+// MergeOptions.RewriteRules.
+func ParseRewriteRule(rule string) (RewriteRule, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	if !ok {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q, expected \"from=to\"", rule)
+	}
+
+	segments := strings.Split(from, "*")
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i, seg := range segments {
+		if i > 0 {
+			pattern.WriteString("(.*)")
+		}
+		pattern.WriteString(regexp.QuoteMeta(seg))
+	}
+	pattern.WriteString("$")
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("compiling rewrite rule %q: %v", rule, err)
+	}
+
+	group := 0
+	to = replaceWildcards(to, func() string {
+		group++
+		return fmt.Sprintf("${%d}", group)
+	})
+
+	return RewriteRule{From: re, To: to}, nil
+}
+
+// replaceWildcards returns s with every "*" replaced by the result of
+// calling next, in order.
+func replaceWildcards(s string, next func() string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '*' {
+			b.WriteString(next())
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// applyRewriteRules returns the address addr would be moved to after
+// applying the first matching rule in rules, or addr unchanged if none
+// match.
+func applyRewriteRules(addr string, rules []RewriteRule) string {
+	for _, rule := range rules {
+		if rule.From.MatchString(addr) {
+			return rule.From.ReplaceAllString(addr, rule.To)
+		}
+	}
+	return addr
+}
@@ -0,0 +1,392 @@
+package tfmerge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// StateSource pulls and pushes Terraform state to and from a remote
+// location. Where the location exposes an explicit lock/unlock primitive
+// (as httpStateSource's backend does), PushState brackets its Push with
+// Lock/Unlock; Pull takes no lock. Backends fronted by the Terraform CLI
+// (backendStateSource) have no such standalone primitive: `terraform state
+// push` already takes the backend's lock for the duration of the write, and
+// Lock/Unlock are no-ops. Merge accepts stateFiles as local paths;
+// resolveStateSource lets a URI (s3://, azurerm://, gs://, consul://,
+// http(s)://, tfe://) stand in for a local path in Merge's stateFiles, by
+// pulling it down to a scratch file first.
+type StateSource interface {
+	// Pull fetches the current state.
+	Pull(ctx context.Context) ([]byte, error)
+	// Push writes state as the new current state.
+	Push(ctx context.Context, state []byte) error
+	// Lock acquires the source's lock, if it has one, and returns a lock ID
+	// to pass to Unlock. Sources with no standalone locking primitive
+	// return "", nil, and rely on Push to be atomic by itself.
+	Lock(ctx context.Context) (string, error)
+	// Unlock releases a lock previously acquired by Lock.
+	Unlock(ctx context.Context, lockID string) error
+	// Close releases any local resources (e.g. a scratch working directory)
+	// the source allocated. Sources with nothing to release return nil.
+	Close() error
+}
+
+// PushState writes state to dest, which may be a local file path or a
+// remote-state backend URI (s3://, azurerm://, gs://, consul://,
+// http(s)://, tfe://). Writes to a backend URI go through the backend's own
+// atomic write (for backendStateSource, `terraform state push`, which takes
+// the backend's lock for the duration of the write; for httpStateSource, an
+// explicit LOCK/UNLOCK pair around the write), so the merged state lands
+// without racing other writers.
+func PushState(ctx context.Context, tf *tfexec.Terraform, dest string, state []byte) error {
+	source, ok, err := resolveStateSource(tf, dest)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %v", dest, err)
+	}
+	if !ok {
+		return os.WriteFile(dest, state, 0600)
+	}
+	defer source.Close()
+
+	lockID, err := source.Lock(ctx)
+	if err != nil {
+		return fmt.Errorf("locking %s: %v", dest, err)
+	}
+	if lockID != "" {
+		defer source.Unlock(ctx, lockID)
+	}
+
+	if err := source.Push(ctx, state); err != nil {
+		return fmt.Errorf("pushing to %s: %v", dest, err)
+	}
+	return nil
+}
+
+// resolveStateSource returns a StateSource for uri, or ok=false if uri is a
+// plain local path rather than a recognized backend URI.
+func resolveStateSource(tf *tfexec.Terraform, uri string) (source StateSource, ok bool, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return nil, false, nil
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &httpStateSource{url: uri}, true, nil
+	case "s3", "azurerm", "gs", "consul", "tfe":
+		backend, config, err := backendConfigFor(u)
+		if err != nil {
+			return nil, true, err
+		}
+		src, err := newBackendStateSource(tf, backend, config)
+		return src, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// backendConfigFor translates a backend URI into the Terraform backend type
+// and the `key = "value"` config attributes it needs, mirroring the schemes
+// documented for the "s3", "azurerm", "gcs", "consul" and "remote"
+// (Terraform Cloud/Enterprise) backends.
+func backendConfigFor(u *url.URL) (backend string, config map[string]string, err error) {
+	config = map[string]string{}
+	for k, v := range u.Query() {
+		if len(v) > 0 {
+			config[k] = v[0]
+		}
+	}
+
+	switch u.Scheme {
+	case "s3":
+		config["bucket"] = u.Host
+		config["key"] = strings.TrimPrefix(u.Path, "/")
+		return "s3", config, nil
+	case "azurerm":
+		config["container_name"] = u.Host
+		config["key"] = strings.TrimPrefix(u.Path, "/")
+		return "azurerm", config, nil
+	case "gs":
+		config["bucket"] = u.Host
+		config["prefix"] = strings.TrimPrefix(u.Path, "/")
+		return "gcs", config, nil
+	case "consul":
+		config["path"] = u.Host + u.Path
+		return "consul", config, nil
+	case "tfe":
+		workspace := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || workspace == "" {
+			return "", nil, fmt.Errorf("invalid tfe:// URI %q, expected tfe://org/workspace", u.String())
+		}
+		config["organization"] = u.Host
+		config["workspaces"] = workspace
+		return "remote", config, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+}
+
+// backendStateSource pulls and pushes state through one of Terraform's own
+// remote-state backends, by pointing a scratch *tfexec.Terraform* working
+// directory at that backend and delegating to `terraform state pull`/
+// `terraform state push`.
+type backendStateSource struct {
+	tf  *tfexec.Terraform
+	dir string
+}
+
+func newBackendStateSource(tf *tfexec.Terraform, backend string, config map[string]string) (*backendStateSource, error) {
+	dir, err := os.MkdirTemp("", "tfmerge-backend-")
+	if err != nil {
+		return nil, fmt.Errorf("creating backend working dir: %v", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "terraform {\n  backend %q {\n", backend)
+	for k, v := range config {
+		fmt.Fprintf(&b, "    %s = %q\n", k, v)
+	}
+	b.WriteString("  }\n}\n")
+	if err := os.WriteFile(filepath.Join(dir, "backend.tf"), []byte(b.String()), 0600); err != nil {
+		return nil, fmt.Errorf("writing backend config: %v", err)
+	}
+
+	backendTF, err := tfexec.NewTerraform(dir, tf.ExecPath())
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("creating backend terraform: %v", err)
+	}
+	if err := backendTF.Init(context.Background()); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("initializing %s backend: %v", backend, err)
+	}
+
+	return &backendStateSource{tf: backendTF, dir: dir}, nil
+}
+
+// Close removes the scratch working directory newBackendStateSource created.
+func (s *backendStateSource) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+func (s *backendStateSource) Pull(ctx context.Context) ([]byte, error) {
+	state, err := s.tf.StatePull(ctx)
+	return []byte(state), err
+}
+
+// Push writes state as the backend's current state via `terraform state
+// push`, which acquires and releases the backend's own lock for the
+// duration of the write, so a single Push is already atomic with respect to
+// other writers. If the backend refuses the push because a previous
+// operation left a stale lock behind, Push force-unlocks it and retries
+// once, rather than failing a merge over a lock nothing is still holding.
+func (s *backendStateSource) Push(ctx context.Context, state []byte) error {
+	path := filepath.Join(s.tf.WorkingDir(), "push.tfstate")
+	if err := os.WriteFile(path, state, 0600); err != nil {
+		return fmt.Errorf("staging state to push: %v", err)
+	}
+
+	err := s.tf.StatePush(ctx, path)
+	lockID, isLockErr := parseLockID(err)
+	if !isLockErr {
+		return err
+	}
+	if unlockErr := s.tf.ForceUnlock(ctx, lockID); unlockErr != nil {
+		return fmt.Errorf("%v (force-unlocking stale lock %s: %v)", err, lockID, unlockErr)
+	}
+	return s.tf.StatePush(ctx, path)
+}
+
+// Lock and Unlock are no-ops: Terraform's CLI has no standalone
+// "state lock" command, since state-modifying operations against a real
+// backend acquire the lock automatically (see Push). A caller stuck behind
+// a stale lock is handled by Push's own force-unlock-and-retry above.
+func (s *backendStateSource) Lock(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+func (s *backendStateSource) Unlock(ctx context.Context, lockID string) error {
+	return nil
+}
+
+// lockIDPattern matches the "ID:" line of the "Lock Info" block Terraform
+// prints when a state-modifying command is refused because another
+// operation already holds the lock.
+var lockIDPattern = regexp.MustCompile(`(?m)^\s*ID:\s+(\S+)`)
+
+// parseLockID reports whether err looks like Terraform's "state locked"
+// error and, if so, extracts the lock ID from it.
+func parseLockID(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	m := lockIDPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// httpStateSource implements StateSource against Terraform's "http" backend
+// protocol directly: a GET returns the current state, and a POST replaces
+// it. Locking uses the same protocol's optional LOCK/UNLOCK methods: the
+// client generates the lock info itself (including its ID) and sends it as
+// the LOCK request body, then sends that same body back with UNLOCK; a
+// server that's already locked responds 423 with the current holder's lock
+// info instead of taking the new one.
+type httpStateSource struct {
+	url string
+
+	// lockInfo is the exact body Lock sent, kept so Unlock can send the same
+	// bytes back rather than reconstructing them from just the lock ID.
+	lockInfo []byte
+}
+
+// httpLockInfo is the JSON shape Terraform's http backend expects in a LOCK
+// request body and returns (for the current holder) in a 423 response,
+// mirroring the fields of Terraform's own statemgr.LockInfo.
+type httpLockInfo struct {
+	ID        string    `json:"ID"`
+	Path      string    `json:"Path"`
+	Operation string    `json:"Operation"`
+	Who       string    `json:"Who"`
+	Version   string    `json:"Version"`
+	Created   time.Time `json:"Created"`
+	Info      string    `json:"Info"`
+}
+
+// newLockID generates a random v4-UUID-shaped lock ID, the same form
+// Terraform itself uses to identify a lock.
+func newLockID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Close is a no-op: httpStateSource holds no local resources, only a URL.
+func (s *httpStateSource) Close() error {
+	return nil
+}
+
+func (s *httpStateSource) Pull(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("pulling state from %s: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("pulling state from %s: unexpected status %s", s.url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *httpStateSource) Push(ctx context.Context, state []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(string(state)))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushing state to %s: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushing state to %s: unexpected status %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpStateSource) Lock(ctx context.Context) (string, error) {
+	id, err := newLockID()
+	if err != nil {
+		return "", fmt.Errorf("generating a lock ID for %s: %v", s.url, err)
+	}
+	body, err := json.Marshal(httpLockInfo{
+		ID:        id,
+		Path:      s.url,
+		Operation: "OperationTypeApply",
+		Who:       "tfmerge",
+		Version:   "1",
+		Created:   time.Now().UTC(),
+		Info:      "tfmerge state push",
+	})
+	if err != nil {
+		return "", fmt.Errorf("encoding lock info for %s: %v", s.url, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "LOCK", s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("locking %s: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusLocked {
+		var holder httpLockInfo
+		if err := json.NewDecoder(resp.Body).Decode(&holder); err == nil && holder.ID != "" {
+			return "", fmt.Errorf("locking %s: already locked by %s (lock ID %s)", s.url, holder.Who, holder.ID)
+		}
+		return "", fmt.Errorf("locking %s: already locked", s.url)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("locking %s: unexpected status %s", s.url, resp.Status)
+	}
+
+	s.lockInfo = body
+	return id, nil
+}
+
+func (s *httpStateSource) Unlock(ctx context.Context, lockID string) error {
+	body := s.lockInfo
+	if body == nil {
+		// Lock wasn't called on this source (or didn't succeed), so there's
+		// no full lock info to resend; fall back to a minimal payload
+		// carrying just the ID the server needs to match against.
+		encoded, err := json.Marshal(httpLockInfo{ID: lockID})
+		if err != nil {
+			return err
+		}
+		body = encoded
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "UNLOCK", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unlocking %s: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unlocking %s: unexpected status %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// Package tfmerge merges multiple Terraform state files into a single state,
+// by shelling out to a Terraform binary (via tfexec) to move each resource
+// address from its source state into a per-source scratch state. Those
+// scratch states are then combined by appending their "resources" at the
+// JSON level, and v1-v3 inputs are upgraded to the v4 format in-process
+// before any of that, so the package reads and writes state JSON itself.
+package tfmerge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// MergeOptions carries optional, non-default behavior for Merge. The zero
+// value (or a nil *MergeOptions) reproduces Merge's original behavior.
+type MergeOptions struct {
+	// RewriteRules are tried, in order, against every resource address
+	// found in each source state (never against baseState); the address is
+	// moved to the target of the first matching rule instead of erroring
+	// out when that would otherwise collide with an address already seen.
+	RewriteRules []RewriteRule
+
+	// Concurrency bounds how many source states are prepared, pulled and
+	// rewritten in parallel. It defaults to runtime.NumCPU().
+	Concurrency int
+
+	// Report, if non-nil, is populated with a MergeReport describing what
+	// this call to Merge did.
+	Report *MergeReport
+}
+
+// Merge merges the state files in stateFiles into baseState (which may be
+// empty) and returns the resulting state in its JSON-encoded wire format.
+// tf is used to run the underlying `terraform state` subcommands, and its
+// working directory is used as the template for each merge worker's own
+// working directory. opts may be nil to accept all defaults.
+//
+// The per-file work (upgrading legacy state, listing its resource
+// addresses, and moving them into a scratch state) runs across a bounded
+// pool of workers sized by opts.Concurrency, since that is what dominates
+// runtime for large fan-ins; only the final conflict-check and write is
+// done serially.
+//
+// Merge fails if any two input states (including baseState) contain the
+// same resource address, since there is no way to tell which copy should
+// win, unless opts.RewriteRules resolves the collision by moving one of the
+// addresses elsewhere.
+//
+// Inputs (including baseState) are not required to already be at state
+// schema v4: any v1-v3 state is detected via its "version" field and
+// transparently upgraded before merging, so archives predating Terraform
+// v0.12 can be merged alongside current states.
+func Merge(ctx context.Context, tf *tfexec.Terraform, baseState []byte, opts *MergeOptions, stateFiles ...string) ([]byte, error) {
+	if opts == nil {
+		opts = &MergeOptions{}
+	}
+
+	if len(baseState) != 0 {
+		upgraded, err := upgradeStateIfLegacy(baseState)
+		if err != nil {
+			return nil, fmt.Errorf("upgrading the base state: %v", err)
+		}
+		baseState = upgraded
+	}
+
+	pulled, err := pullStatesConcurrently(ctx, tf, stateFiles, opts.RewriteRules, opts.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, p := range pulled {
+			if p.workerDir != "" {
+				os.RemoveAll(p.workerDir)
+			}
+		}
+	}()
+
+	var baseAddrs []string
+	seen := map[string]string{}
+	if len(baseState) != 0 {
+		baseAddrs, err = stateAddressesFromBytes(baseState)
+		if err != nil {
+			return nil, fmt.Errorf("listing resources of the base state: %v", err)
+		}
+		for _, addr := range baseAddrs {
+			seen[addr] = "<base state>"
+		}
+	}
+	for _, p := range pulled {
+		for _, addr := range p.addrs {
+			if src, ok := seen[addr]; ok {
+				return nil, fmt.Errorf("resource %s exists in both %s and %s", addr, src, p.source)
+			}
+			seen[addr] = p.source
+		}
+	}
+
+	if opts.Report != nil {
+		report, err := buildReport(baseState, baseAddrs, pulled)
+		if err != nil {
+			return nil, fmt.Errorf("building merge report: %v", err)
+		}
+		*opts.Report = *report
+	}
+
+	return combinePulledStates(baseState, pulled)
+}
+
+// MergeAndPush merges stateFiles into baseState exactly as Merge does, then
+// writes the result to dest via PushState - a local file path or a
+// remote-state backend URI (s3://, azurerm://, gs://, consul://,
+// http(s)://, tfe://) - instead of leaving the caller to write out the
+// bytes Merge returns. This is what makes "the output destination can be a
+// backend URI" apply to the merge itself, not just its inputs.
+func MergeAndPush(ctx context.Context, tf *tfexec.Terraform, baseState []byte, dest string, opts *MergeOptions, stateFiles ...string) error {
+	merged, err := Merge(ctx, tf, baseState, opts, stateFiles...)
+	if err != nil {
+		return err
+	}
+	return PushState(ctx, tf, dest, merged)
+}
+
+// upgradeStateIfLegacy upgrades data to state schema v4 if it is currently
+// at an older version, otherwise it is returned unchanged.
+func upgradeStateIfLegacy(data []byte) ([]byte, error) {
+	version, err := detectStateVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if version >= 4 {
+		return data, nil
+	}
+	return upgradeLegacyState(data)
+}
+
+// prepareStateFile returns the path to a state file Merge can operate on
+// directly: if the file at path is already at schema v4 it is returned
+// as-is, otherwise it is upgraded and the result is written to a scratch
+// file in tf's working directory.
+func prepareStateFile(tf *tfexec.Terraform, path string, index int) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	version, err := detectStateVersion(data)
+	if err != nil {
+		return "", fmt.Errorf("detecting state version of %s: %v", path, err)
+	}
+	if version >= 4 {
+		return path, nil
+	}
+
+	upgraded, err := upgradeLegacyState(data)
+	if err != nil {
+		return "", fmt.Errorf("upgrading %s from state v%d: %v", path, version, err)
+	}
+
+	upgradedPath := filepath.Join(tf.WorkingDir(), fmt.Sprintf("upgraded-%d.tfstate", index))
+	if err := os.WriteFile(upgradedPath, upgraded, 0600); err != nil {
+		return "", fmt.Errorf("writing upgraded state for %s: %v", path, err)
+	}
+	return upgradedPath, nil
+}
+
+// stateAddresses returns the resource addresses (including those nested in
+// child modules) found in the state file at stateFile.
+func stateAddresses(ctx context.Context, tf *tfexec.Terraform, stateFile string) ([]string, error) {
+	state, err := tf.ShowStateFile(ctx, stateFile)
+	if err != nil {
+		return nil, err
+	}
+	if state.Values == nil || state.Values.RootModule == nil {
+		return nil, nil
+	}
+	var addrs []string
+	collectAddresses(state.Values.RootModule, &addrs)
+	return addrs, nil
+}
+
+func collectAddresses(m *tfjson.StateModule, addrs *[]string) {
+	for _, r := range m.Resources {
+		*addrs = append(*addrs, r.Address)
+	}
+	for _, child := range m.ChildModules {
+		collectAddresses(child, addrs)
+	}
+}
+
+// stateAddressesFromBytes computes the same resource addresses stateAddresses
+// would, but by reading the raw v4 state JSON directly instead of shelling
+// out to `terraform show`. It's used for baseState, which Merge never writes
+// to disk on its own.
+func stateAddressesFromBytes(data []byte) ([]string, error) {
+	var s struct {
+		Resources []struct {
+			Module    string `json:"module"`
+			Mode      string `json:"mode"`
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Instances []struct {
+				IndexKey interface{} `json:"index_key"`
+			} `json:"instances"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing state: %v", err)
+	}
+
+	var addrs []string
+	for _, r := range s.Resources {
+		base := r.Type + "." + r.Name
+		if r.Mode == "data" {
+			base = "data." + base
+		}
+		if r.Module != "" {
+			base = r.Module + "." + base
+		}
+		if len(r.Instances) == 0 {
+			addrs = append(addrs, base)
+			continue
+		}
+		for _, inst := range r.Instances {
+			switch k := inst.IndexKey.(type) {
+			case string:
+				addrs = append(addrs, fmt.Sprintf("%s[%q]", base, k))
+			case float64:
+				addrs = append(addrs, fmt.Sprintf("%s[%d]", base, int(k)))
+			default:
+				addrs = append(addrs, base)
+			}
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,74 @@
+package tfmerge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// genStateFiles writes n single-resource v4 state files to dir, each with a
+// distinct resource address, and returns their paths.
+func genStateFiles(b *testing.B, dir string, n int) []string {
+	b.Helper()
+
+	const template = `{
+  "version": 4,
+  "terraform_version": "1.2.8",
+  "serial": 1,
+  "lineage": "00000000-0000-0000-0000-%012d",
+  "outputs": {},
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "bench%d",
+      "provider": "provider[\"registry.terraform.io/hashicorp/null\"]",
+      "instances": [
+        {
+          "schema_version": 0,
+          "attributes": {},
+          "sensitive_attributes": [],
+          "private": "bnVsbA=="
+        }
+      ]
+    }
+  ]
+}
+`
+
+	paths := make([]string, n)
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("state-%d.tfstate", i))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(template, i, i)), 0600); err != nil {
+			b.Fatalf("writing fixture %s: %v", path, err)
+		}
+		paths[i] = path
+	}
+	return paths
+}
+
+// BenchmarkMerge demonstrates how Merge's worker pool scales concurrency
+// against the number of source states being fanned in. Run with
+// `go test -bench BenchmarkMerge -benchtime 3x` (a handful of small state
+// files still spends most of its time on Terraform process startup, so a
+// small -benchtime keeps this from dominating `go test`).
+func BenchmarkMerge(b *testing.B) {
+	for _, n := range []int{4, 16, 64} {
+		for _, concurrency := range []int{1, 4, 0} { // 0 means opts.Concurrency's default (runtime.NumCPU())
+			b.Run(fmt.Sprintf("states=%d/concurrency=%d", n, concurrency), func(b *testing.B) {
+				ctx := context.Background()
+				tf := initTest(ctx, b)
+				stateFiles := genStateFiles(b, b.TempDir(), n)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := Merge(ctx, tf, nil, &MergeOptions{Concurrency: concurrency}, stateFiles...); err != nil {
+						b.Fatalf("Merge: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -3,8 +3,12 @@ package tfmerge
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -15,10 +19,11 @@ import (
 	"github.com/hashicorp/hc-install/product"
 	"github.com/hashicorp/hc-install/src"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/stretchr/testify/require"
 )
 
-func initTest(ctx context.Context, t *testing.T) *tfexec.Terraform {
+func initTest(ctx context.Context, t testing.TB) *tfexec.Terraform {
 	// Discard log output
 	log.SetOutput(io.Discard)
 
@@ -219,6 +224,10 @@ func TestMerge(t *testing.T) {
 			name: "Module conflict are the same resource",
 			dir:  "module_conflict_same_id",
 		},
+		{
+			name: "Legacy v3 state is upgraded before merging",
+			dir:  "legacy_v3",
+		},
 	}
 
 	for _, tt := range cases {
@@ -228,7 +237,7 @@ func TestMerge(t *testing.T) {
 			ctx := context.Background()
 			tf := initTest(ctx, t)
 			stateFiles, expect := testFixture(t, tt.dir)
-			actual, err := Merge(context.Background(), tf, []byte(tt.baseState), stateFiles...)
+			actual, err := Merge(context.Background(), tf, []byte(tt.baseState), nil, stateFiles...)
 			if tt.hasError {
 				require.Error(t, err)
 				return
@@ -238,3 +247,400 @@ func TestMerge(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectStateVersion(t *testing.T) {
+	v, err := detectStateVersion([]byte(`{"version": 3}`))
+	require.NoError(t, err)
+	require.Equal(t, 3, v)
+}
+
+func TestUpgradeLegacyState(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "legacy_v3", "terraform.tfstate"))
+	require.NoError(t, err)
+
+	v, err := detectStateVersion(b)
+	require.NoError(t, err)
+	require.Equal(t, 3, v)
+
+	upgraded, err := upgradeLegacyState(b)
+	require.NoError(t, err)
+
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(upgraded, &state))
+	require.EqualValues(t, 4, state["version"])
+
+	resources := state["resources"].([]interface{})
+	require.Len(t, resources, 1)
+	resource := resources[0].(map[string]interface{})
+	require.Equal(t, "null_resource", resource["type"])
+	require.Equal(t, "legacy", resource["name"])
+	require.Equal(t, `provider["registry.terraform.io/hashicorp/null"]`, resource["provider"])
+
+	instances := resource["instances"].([]interface{})
+	require.Len(t, instances, 1)
+	instance := instances[0].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"id": "123456789", "triggers": nil}, instance["attributes"])
+	require.Nil(t, instance["attributes_flat"])
+}
+
+func TestExpandFlatmapAttributesNumericKeyedMap(t *testing.T) {
+	// ports = {"80" = "open"} flattens to ports.%=1, ports.80=open; the "%"
+	// sigil marks it as a map, even though its only key also happens to
+	// parse as a list index.
+	got := expandFlatmapAttributes(map[string]string{
+		"ports.%":  "1",
+		"ports.80": "open",
+	})
+	require.Equal(t, map[string]interface{}{"ports": map[string]interface{}{"80": "open"}}, got)
+}
+
+func TestExpandFlatmapAttributesList(t *testing.T) {
+	got := expandFlatmapAttributes(map[string]string{
+		"tags.#": "2",
+		"tags.0": "a",
+		"tags.1": "b",
+	})
+	require.Equal(t, map[string]interface{}{"tags": []interface{}{"a", "b"}}, got)
+}
+
+func TestMergePlanValues(t *testing.T) {
+	planA := &tfjson.Plan{
+		ResourceChanges: []*tfjson.ResourceChange{
+			{Address: "null_resource.a"},
+		},
+		PlannedValues: &tfjson.StateValues{
+			RootModule: &tfjson.StateModule{
+				Resources: []*tfjson.StateResource{
+					{Address: "null_resource.a"},
+				},
+			},
+		},
+	}
+	planB := &tfjson.Plan{
+		ResourceChanges: []*tfjson.ResourceChange{
+			{Address: "null_resource.b"},
+		},
+		PlannedValues: &tfjson.StateValues{
+			RootModule: &tfjson.StateModule{
+				Resources: []*tfjson.StateResource{
+					{Address: "null_resource.b"},
+				},
+				ChildModules: []*tfjson.StateModule{
+					{
+						Address: "module.child",
+						Resources: []*tfjson.StateResource{
+							{Address: "module.child.null_resource.c"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	merged, err := mergePlanValues([]string{"a.tfplan", "b.tfplan"}, planA, planB)
+	require.NoError(t, err)
+	require.Len(t, merged.ResourceChanges, 2)
+	require.Len(t, merged.PlannedValues.RootModule.Resources, 2)
+	require.Len(t, merged.PlannedValues.RootModule.ChildModules, 1)
+	require.Len(t, merged.PlannedValues.RootModule.ChildModules[0].Resources, 1)
+}
+
+func TestMergePlanValuesConflict(t *testing.T) {
+	planA := &tfjson.Plan{
+		ResourceChanges: []*tfjson.ResourceChange{
+			{Address: "null_resource.a"},
+		},
+	}
+	planB := &tfjson.Plan{
+		ResourceChanges: []*tfjson.ResourceChange{
+			{Address: "null_resource.a"},
+		},
+	}
+
+	_, err := mergePlanValues([]string{"a.tfplan", "b.tfplan"}, planA, planB)
+	require.Error(t, err)
+}
+
+func TestSplitAddress(t *testing.T) {
+	cases := []struct {
+		addr              string
+		module, typ, name string
+	}{
+		{"null_resource.a", "", "null_resource", "a"},
+		{"module.a.null_resource.b", "module.a", "null_resource", "b"},
+		{"module.a.module.b.null_resource.c", "module.a.module.b", "null_resource", "c"},
+		{"data.aws_ami.foo", "", "aws_ami", "foo"},
+		{`null_resource.a["key"]`, "", "null_resource", "a"},
+	}
+	for _, tt := range cases {
+		module, typ, name := splitAddress(tt.addr)
+		require.Equal(t, tt.module, module, tt.addr)
+		require.Equal(t, tt.typ, typ, tt.addr)
+		require.Equal(t, tt.name, name, tt.addr)
+	}
+}
+
+func TestBuildReportNearConflict(t *testing.T) {
+	report, err := buildReport(nil, nil, []pulledState{
+		{source: "a.tfstate", origAddrs: []string{"null_resource.test"}, addrs: []string{"null_resource.test"}},
+		{source: "b.tfstate", origAddrs: []string{"null_resource.test"}, addrs: []string{"module.b.null_resource.test"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, report.NearConflicts, 1)
+	require.Equal(t, "null_resource", report.NearConflicts[0].Type)
+	require.ElementsMatch(t, []string{"null_resource.test", "module.b.null_resource.test"}, report.NearConflicts[0].Addresses)
+}
+
+func TestBuildReportRewritten(t *testing.T) {
+	report, err := buildReport(nil, nil, []pulledState{
+		{source: "a.tfstate", origAddrs: []string{"module.a.null_resource.test"}, addrs: []string{"module.shard1.a.null_resource.test"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"module.a.null_resource.test": "module.shard1.a.null_resource.test"}, report.Sources[0].Rewritten)
+}
+
+func TestBackendConfigFor(t *testing.T) {
+	u, err := neturl.Parse("s3://my-bucket/env/prod/terraform.tfstate?region=us-east-1")
+	require.NoError(t, err)
+
+	backend, config, err := backendConfigFor(u)
+	require.NoError(t, err)
+	require.Equal(t, "s3", backend)
+	require.Equal(t, "my-bucket", config["bucket"])
+	require.Equal(t, "env/prod/terraform.tfstate", config["key"])
+	require.Equal(t, "us-east-1", config["region"])
+}
+
+func TestBackendConfigForTFE(t *testing.T) {
+	u, err := neturl.Parse("tfe://my-org/my-workspace")
+	require.NoError(t, err)
+
+	backend, config, err := backendConfigFor(u)
+	require.NoError(t, err)
+	require.Equal(t, "remote", backend)
+	require.Equal(t, "my-org", config["organization"])
+	require.Equal(t, "my-workspace", config["workspaces"])
+}
+
+func TestHTTPStateSourcePullPush(t *testing.T) {
+	var stored []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write(stored)
+		case http.MethodPost:
+			b, _ := io.ReadAll(r.Body)
+			stored = b
+		}
+	}))
+	defer srv.Close()
+
+	source := &httpStateSource{url: srv.URL}
+	require.NoError(t, source.Push(context.Background(), []byte(`{"version":4}`)))
+
+	got, err := source.Pull(context.Background())
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version":4}`, string(got))
+}
+
+func TestHTTPStateSourceLockUnlock(t *testing.T) {
+	var holder *httpLockInfo
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "LOCK":
+			var info httpLockInfo
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&info))
+			require.NotEmpty(t, info.ID, "LOCK request body should carry a client-generated lock ID")
+			if holder != nil {
+				w.WriteHeader(http.StatusLocked)
+				require.NoError(t, json.NewEncoder(w).Encode(holder))
+				return
+			}
+			holder = &info
+		case "UNLOCK":
+			var info httpLockInfo
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&info))
+			require.Equal(t, holder.ID, info.ID, "UNLOCK should send back the ID LOCK generated")
+			holder = nil
+		}
+	}))
+	defer srv.Close()
+
+	source := &httpStateSource{url: srv.URL}
+	lockID, err := source.Lock(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, lockID)
+
+	other := &httpStateSource{url: srv.URL}
+	_, err = other.Lock(context.Background())
+	require.Error(t, err, "a second Lock should be refused while the first holds the lock")
+
+	require.NoError(t, source.Unlock(context.Background(), lockID))
+
+	lockID2, err := other.Lock(context.Background())
+	require.NoError(t, err, "Lock should succeed again once the first holder unlocked")
+	require.NoError(t, other.Unlock(context.Background(), lockID2))
+}
+
+func TestMergeAndPushToHTTPBackend(t *testing.T) {
+	var stored []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write(stored)
+		case http.MethodPost:
+			b, _ := io.ReadAll(r.Body)
+			stored = b
+		}
+	}))
+	defer srv.Close()
+
+	tf, err := tfexec.NewTerraform(t.TempDir(), "terraform")
+	require.NoError(t, err)
+
+	err = MergeAndPush(context.Background(), tf, nil, srv.URL, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, stored)
+
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(stored, &state))
+	require.EqualValues(t, 4, state["version"])
+}
+
+func TestBackendStateSourceCloseRemovesDir(t *testing.T) {
+	dir := t.TempDir()
+	tf, err := tfexec.NewTerraform(dir, "terraform")
+	require.NoError(t, err)
+
+	source := &backendStateSource{tf: tf, dir: dir}
+	require.NoError(t, source.Close())
+
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err), "Close should have removed the backend's scratch dir")
+}
+
+func TestParseLockID(t *testing.T) {
+	err := fmt.Errorf(`Error acquiring the state lock
+
+Error message: state blob is already locked
+Lock Info:
+  ID:        d0e7f9c1-1234-5678-9abc-def012345678
+  Path:      tfmerge/terraform.tfstate
+  Operation: OperationTypeApply
+  Who:       someone@somewhere
+  Version:   1.5.0
+  Created:   2024-01-01 00:00:00 UTC
+`)
+	id, ok := parseLockID(err)
+	require.True(t, ok)
+	require.Equal(t, "d0e7f9c1-1234-5678-9abc-def012345678", id)
+
+	_, ok = parseLockID(fmt.Errorf("some unrelated error"))
+	require.False(t, ok)
+}
+
+func TestCombinePulledStates(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "pulled.tfstate")
+	require.NoError(t, os.WriteFile(statePath, []byte(`{
+  "version": 4,
+  "lineage": "11111111-1111-1111-1111-111111111111",
+  "resources": [
+    {"mode": "managed", "type": "null_resource", "name": "a"}
+  ]
+}`), 0600))
+
+	merged, err := combinePulledStates(nil, []pulledState{
+		{source: "a.tfstate", addrs: []string{"null_resource.a"}, statePath: statePath},
+	})
+	require.NoError(t, err)
+
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(merged, &state))
+	require.EqualValues(t, 4, state["version"])
+	require.EqualValues(t, 1, state["serial"])
+	require.Len(t, state["resources"], 1)
+}
+
+func TestCombinePulledStatesEmptyFirstSource(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "pulled.tfstate")
+	require.NoError(t, os.WriteFile(statePath, []byte(`{
+  "version": 4,
+  "lineage": "11111111-1111-1111-1111-111111111111",
+  "resources": [
+    {"mode": "managed", "type": "null_resource", "name": "b"}
+  ]
+}`), 0600))
+
+	// The first source contributed no resources, so pullState never wrote
+	// its statePath; combinePulledStates must not try to read it as the
+	// seed.
+	merged, err := combinePulledStates(nil, []pulledState{
+		{source: "a.tfstate", addrs: nil, statePath: filepath.Join(dir, "never-written.tfstate")},
+		{source: "b.tfstate", addrs: []string{"null_resource.b"}, statePath: statePath},
+	})
+	require.NoError(t, err)
+
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal(merged, &state))
+	require.EqualValues(t, 4, state["version"])
+	require.EqualValues(t, 2, state["serial"])
+	require.Len(t, state["resources"], 1)
+}
+
+func TestCopyDirSharesTerraformDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, ".terraform", "providers"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, ".terraform", "providers", "terraform-provider-null"), []byte("fake plugin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, ".terraform.lock.hcl"), []byte("locked"), 0644))
+
+	dst := t.TempDir()
+	require.NoError(t, copyDir(src, dst))
+
+	info, err := os.Lstat(filepath.Join(dst, ".terraform"))
+	require.NoError(t, err)
+	require.True(t, info.Mode()&os.ModeSymlink != 0, "expected .terraform to be a symlink, not a copy")
+
+	lockInfo, err := os.Lstat(filepath.Join(dst, ".terraform.lock.hcl"))
+	require.NoError(t, err)
+	require.False(t, lockInfo.Mode()&os.ModeSymlink != 0)
+
+	pluginInfo, err := os.Stat(filepath.Join(dst, ".terraform", "providers", "terraform-provider-null"))
+	require.NoError(t, err)
+	require.NotZero(t, pluginInfo.Mode()&0111, "provider plugin copied through the shared .terraform dir should stay executable")
+}
+
+func TestPullStateSetsWorkerDirOnError(t *testing.T) {
+	// tf's working directory is empty and stateFile doesn't exist anywhere,
+	// so pullState fails while preparing it, well before ever needing a real
+	// terraform binary. The worker dir it created along the way must still
+	// be reported back so the caller can remove it.
+	tf, err := tfexec.NewTerraform(t.TempDir(), "terraform")
+	require.NoError(t, err)
+
+	result, err := pullState(context.Background(), tf, "does-not-exist.tfstate", 0, nil)
+	require.Error(t, err)
+	require.NotEmpty(t, result.workerDir)
+
+	_, statErr := os.Stat(result.workerDir)
+	require.NoError(t, statErr, "workerDir should still exist for the caller to clean up")
+	require.NoError(t, os.RemoveAll(result.workerDir))
+}
+
+func TestParseRewriteRule(t *testing.T) {
+	rule, err := ParseRewriteRule("module.a.*=module.shard1.a.*")
+	require.NoError(t, err)
+
+	require.True(t, rule.From.MatchString("module.a.null_resource.test"))
+	require.Equal(t, "module.shard1.a.null_resource.test", rule.From.ReplaceAllString("module.a.null_resource.test", rule.To))
+	require.False(t, rule.From.MatchString("module.b.null_resource.test"))
+}
+
+func TestApplyRewriteRules(t *testing.T) {
+	rule, err := ParseRewriteRule("module.a.*=module.shard1.a.*")
+	require.NoError(t, err)
+
+	require.Equal(t, "module.shard1.a.null_resource.test", applyRewriteRules("module.a.null_resource.test", []RewriteRule{rule}))
+	require.Equal(t, "null_resource.untouched", applyRewriteRules("null_resource.untouched", []RewriteRule{rule}))
+}